@@ -0,0 +1,297 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/nats-io/nats.go"
+
+	"github.com/graphite-ng/carbon-relay-ng/matcher"
+	"github.com/graphite-ng/carbon-relay-ng/stats"
+)
+
+// subjectParts is handed to a route's SubjectTemplate so operators can
+// interpolate hierarchy into the NATS subject, e.g.
+// "metrics.{{.Prefix1}}.{{.Prefix2}}".
+type subjectParts struct {
+	Key     string
+	Prefix1 string
+	Prefix2 string
+	Prefix3 string
+}
+
+func newSubjectParts(key []byte) subjectParts {
+	fields := strings.SplitN(string(key), ".", 4)
+	p := subjectParts{Key: string(key)}
+	if len(fields) > 0 {
+		p.Prefix1 = fields[0]
+	}
+	if len(fields) > 1 {
+		p.Prefix2 = fields[1]
+	}
+	if len(fields) > 2 {
+		p.Prefix3 = fields[2]
+	}
+	return p
+}
+
+// Nats publishes matching metrics to a NATS subject, optionally via
+// JetStream for durability, using the same batching knobs as kafkaMdm.
+type Nats struct {
+	key     string
+	matcher matcher.Matcher
+
+	url         string
+	subject     string
+	credsFile   string
+	stream      string
+	subjectTmpl *template.Template
+
+	bufSize      int
+	flushMaxNum  int
+	flushMaxWait time.Duration
+	timeout      time.Duration
+
+	conn *nats.Conn
+	js   nats.JetStreamContext
+
+	numDropped metrics.Counter
+
+	mu       sync.Mutex
+	buf      [][]byte
+	bufBytes int
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewNats creates a Nats route and connects to NatsURL. If stream is
+// non-empty, publishes go through JetStream (with ack) instead of core NATS.
+func NewNats(key, prefix, sub, regex, natsURL, subject, credsFile, stream, subjectTemplate string, bufSize, flushMaxNum, flushMaxWait, timeout int) (Route, error) {
+	m, err := matcher.New(prefix, sub, regex)
+	if err != nil {
+		return nil, err
+	}
+
+	var tmpl *template.Template
+	if subjectTemplate != "" {
+		tmpl, err = template.New(key + "-subject").Parse(subjectTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subject template for route '%s': %s", key, err.Error())
+		}
+	}
+
+	opts := []nats.Option{nats.Name("carbon-relay-ng")}
+	if credsFile != "" {
+		opts = append(opts, nats.UserCredentials(credsFile))
+	}
+
+	conn, err := nats.Connect(natsURL, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to nats for route '%s': %s", key, err.Error())
+	}
+
+	var js nats.JetStreamContext
+	if stream != "" {
+		js, err = conn.JetStream()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not get jetstream context for route '%s': %s", key, err.Error())
+		}
+	}
+
+	r := &Nats{
+		key:          key,
+		matcher:      *m,
+		url:          natsURL,
+		subject:      subject,
+		credsFile:    credsFile,
+		stream:       stream,
+		subjectTmpl:  tmpl,
+		bufSize:      bufSize,
+		flushMaxNum:  flushMaxNum,
+		flushMaxWait: time.Duration(flushMaxWait) * time.Millisecond,
+		timeout:      time.Duration(timeout) * time.Millisecond,
+		conn:         conn,
+		js:           js,
+		numDropped:   stats.Counter(fmt.Sprintf("unit=Metric.direction=dropped.route=%s", key)),
+		buf:          make([][]byte, 0, flushMaxNum),
+		shutdown:     make(chan struct{}),
+	}
+
+	r.wg.Add(1)
+	go r.run()
+
+	return r, nil
+}
+
+func (r *Nats) subjectFor(key []byte) string {
+	r.mu.Lock()
+	tmpl := r.subjectTmpl
+	subject := r.subject
+	r.mu.Unlock()
+
+	if tmpl == nil {
+		return subject
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, newSubjectParts(key)); err != nil {
+		return subject
+	}
+	return out.String()
+}
+
+func (r *Nats) Key() string {
+	return r.key
+}
+
+func (r *Nats) Match(key []byte) bool {
+	r.mu.Lock()
+	m := r.matcher
+	r.mu.Unlock()
+	return m.Match(key)
+}
+
+// Dispatch enqueues buf for the next flush, which run() triggers every
+// flushMaxWait. Once flushMaxNum entries are buffered, Dispatch calls Flush
+// itself, so the caller waits for that batch to be published. If the
+// buffered bytes would exceed bufSize, buf is dropped (and counted) rather
+// than grown further.
+func (r *Nats) Dispatch(buf []byte) {
+	cp := make([]byte, len(buf))
+	copy(cp, buf)
+
+	r.mu.Lock()
+	if r.bufBytes+len(cp) > r.bufSize {
+		r.mu.Unlock()
+		r.numDropped.Inc(1)
+		return
+	}
+	r.buf = append(r.buf, cp)
+	r.bufBytes += len(cp)
+	full := len(r.buf) >= r.flushMaxNum
+	r.mu.Unlock()
+
+	if full {
+		r.Flush()
+	}
+}
+
+func (r *Nats) run() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.flushMaxWait)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.Flush()
+		case <-r.shutdown:
+			r.Flush()
+			return
+		}
+	}
+}
+
+// Flush publishes all buffered metrics, each to the subject derived from its
+// own key (so a SubjectTemplate can fan a single route out across subjects).
+// A publish failure doesn't abort the batch: every pending entry is still
+// attempted, since pending has already been swapped out of r.buf and
+// bailing early would silently drop whatever's left.
+func (r *Nats) Flush() error {
+	r.mu.Lock()
+	pending := r.buf
+	r.buf = make([][]byte, 0, r.flushMaxNum)
+	r.bufBytes = 0
+	r.mu.Unlock()
+
+	var firstErr error
+	failed := 0
+	for _, buf := range pending {
+		fields := bytes.Fields(buf)
+		if len(fields) == 0 {
+			continue
+		}
+		subject := r.subjectFor(fields[0])
+
+		var err error
+		if r.js != nil {
+			_, err = r.js.Publish(subject, buf, nats.AckWait(r.timeout))
+		} else {
+			err = r.conn.Publish(subject, buf)
+		}
+		if err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("nats route '%s': %d of %d publishes failed, first error: %s", r.key, failed, len(pending), firstErr.Error())
+	}
+	return nil
+}
+
+func (r *Nats) Shutdown() error {
+	close(r.shutdown)
+	r.wg.Wait()
+	r.conn.Close()
+	return nil
+}
+
+func (r *Nats) Snapshot() Snapshot {
+	r.mu.Lock()
+	m := r.matcher
+	r.mu.Unlock()
+
+	return Snapshot{
+		Type:    "nats",
+		Key:     r.key,
+		Matcher: m,
+		Dests: []Destination{
+			{
+				Matcher: m,
+				Addr:    r.url,
+				Online:  r.conn.IsConnected(),
+			},
+		},
+	}
+}
+
+// a Nats route has a single logical destination (the NATS cluster), so
+// per-destination operations aren't supported and always return an error.
+func (r *Nats) DelDestination(index int) error {
+	return fmt.Errorf("route '%s' does not support per-destination deletes", r.key)
+}
+
+func (r *Nats) UpdateDestination(index int, opts map[string]string) error {
+	return fmt.Errorf("route '%s' does not support per-destination updates", r.key)
+}
+
+func (r *Nats) Update(opts map[string]string) error {
+	_, hasPrefix := opts["prefix"]
+	_, hasSub := opts["sub"]
+	_, hasRegex := opts["regex"]
+	var m *matcher.Matcher
+	if hasPrefix || hasSub || hasRegex {
+		var err error
+		m, err = matcher.New(opts["prefix"], opts["sub"], opts["regex"])
+		if err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if subject, ok := opts["subject"]; ok {
+		r.subject = subject
+	}
+	if m != nil {
+		r.matcher = *m
+	}
+	return nil
+}
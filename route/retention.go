@@ -0,0 +1,184 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/graphite-ng/carbon-relay-ng/matcher"
+	"github.com/graphite-ng/carbon-relay-ng/stats"
+	"github.com/graphite-ng/carbon-relay-ng/table/retention"
+)
+
+// RetentionRoute dispatches each metric to the destination bucket keyed by
+// the coarsest rollup of its storage-schemas.conf entry, so operators can
+// shard traffic to different Cassandra/Kafka topics per retention tier
+// without running one route per tier.
+type RetentionRoute struct {
+	key string
+
+	mu      sync.Mutex
+	matcher matcher.Matcher
+	policy  *retention.Policy
+
+	// destinations is keyed by Retention.String(), e.g. "1h:2y".
+	destinations map[string]Route
+	// fallback is used when no schema matches, or the matched schema's
+	// tier has no destination configured. may be nil, in which case
+	// unmatched metrics are dropped (and counted via numDropped) instead.
+	fallback Route
+
+	numDropped metrics.Counter
+}
+
+// NewRetentionRoute creates a RetentionRoute, loading its retention policy
+// from schemasFile. destinations and fallback must already be running.
+// fallback may be nil if every tier is expected to have its own destination.
+func NewRetentionRoute(key, prefix, sub, regex, schemasFile string, destinations map[string]Route, fallback Route) (Route, error) {
+	m, err := matcher.New(prefix, sub, regex)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := retention.ParseFile(schemasFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load schemas file for route '%s': %s", key, err.Error())
+	}
+
+	return &RetentionRoute{
+		key:          key,
+		matcher:      *m,
+		policy:       policy,
+		destinations: destinations,
+		fallback:     fallback,
+		numDropped:   stats.Counter(fmt.Sprintf("unit=Metric.direction=dropped.route=%s", key)),
+	}, nil
+}
+
+func (r *RetentionRoute) Key() string {
+	return r.key
+}
+
+func (r *RetentionRoute) Match(key []byte) bool {
+	r.mu.Lock()
+	m := r.matcher
+	r.mu.Unlock()
+	return m.Match(key)
+}
+
+// destinationFor resolves the destination bucket for a metric key, falling
+// back to r.fallback if no schema matches or the tier has nothing wired up.
+func (r *RetentionRoute) destinationFor(key []byte) Route {
+	r.mu.Lock()
+	policy := r.policy
+	r.mu.Unlock()
+
+	schema, ok := policy.Match(string(key))
+	if !ok {
+		return r.fallback
+	}
+	dest, ok := r.destinations[schema.Coarsest().String()]
+	if !ok {
+		return r.fallback
+	}
+	return dest
+}
+
+func (r *RetentionRoute) Dispatch(buf []byte) {
+	fields := bytes.Fields(buf)
+	if len(fields) == 0 {
+		return
+	}
+	dest := r.destinationFor(fields[0])
+	if dest == nil {
+		r.numDropped.Inc(1)
+		return
+	}
+	dest.Dispatch(buf)
+}
+
+func (r *RetentionRoute) Flush() error {
+	for _, d := range r.destinations {
+		if err := d.Flush(); err != nil {
+			return err
+		}
+	}
+	if r.fallback != nil {
+		return r.fallback.Flush()
+	}
+	return nil
+}
+
+func (r *RetentionRoute) Shutdown() error {
+	for _, d := range r.destinations {
+		if err := d.Shutdown(); err != nil {
+			return err
+		}
+	}
+	if r.fallback != nil {
+		return r.fallback.Shutdown()
+	}
+	return nil
+}
+
+func (r *RetentionRoute) Snapshot() Snapshot {
+	r.mu.Lock()
+	m := r.matcher
+	r.mu.Unlock()
+
+	dests := make([]Destination, 0, len(r.destinations))
+	for tier, d := range r.destinations {
+		for _, ds := range d.Snapshot().Dests {
+			ds.Addr = tier + "@" + ds.Addr
+			dests = append(dests, ds)
+		}
+	}
+	return Snapshot{
+		Type:    "retentionRoute",
+		Key:     r.key,
+		Matcher: m,
+		Dests:   dests,
+	}
+}
+
+// a RetentionRoute's destinations are keyed by retention tier, not index, so
+// per-index destination operations aren't supported; reconfigure tiers via
+// the route's config instead.
+func (r *RetentionRoute) DelDestination(index int) error {
+	return fmt.Errorf("route '%s' does not support deleting destinations by index", r.key)
+}
+
+func (r *RetentionRoute) UpdateDestination(index int, opts map[string]string) error {
+	return fmt.Errorf("route '%s' does not support updating destinations by index", r.key)
+}
+
+func (r *RetentionRoute) Update(opts map[string]string) error {
+	_, hasPrefix := opts["prefix"]
+	_, hasSub := opts["sub"]
+	_, hasRegex := opts["regex"]
+	if hasPrefix || hasSub || hasRegex {
+		m, err := matcher.New(opts["prefix"], opts["sub"], opts["regex"])
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.matcher = *m
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// ReloadSchemas re-parses the schemas file backing this route's retention
+// policy, so the imperatives interface can hot-reload retention tiers
+// without restarting the route.
+func (r *RetentionRoute) ReloadSchemas(schemasFile string) error {
+	policy, err := retention.ParseFile(schemasFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.policy = policy
+	r.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,78 @@
+// Package syncutil holds small concurrency primitives shared across
+// carbon-relay-ng packages.
+package syncutil
+
+import (
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+)
+
+// Gate is an N-slot semaphore implemented as a buffered channel. it lets
+// callers cap how many goroutines are doing concurrent work (e.g. dispatching
+// to routes, or opening outbound connections) without each call site having
+// to roll its own pool.
+type Gate chan struct{}
+
+// NewGate returns a Gate that allows up to n concurrent holders.
+// n <= 0 is treated as unbounded: Start never blocks.
+func NewGate(n int) Gate {
+	if n <= 0 {
+		return nil
+	}
+	return make(Gate, n)
+}
+
+// Start acquires a slot, blocking if the gate is already at capacity.
+// An unbounded Gate (nil) always returns immediately.
+func (g Gate) Start() {
+	if g == nil {
+		return
+	}
+	g <- struct{}{}
+}
+
+// Done releases a slot acquired via Start.
+func (g Gate) Done() {
+	if g == nil {
+		return
+	}
+	<-g
+}
+
+// Len returns the number of slots currently in use.
+func (g Gate) Len() int {
+	return len(g)
+}
+
+// Cap returns the gate's total width, or 0 for an unbounded gate.
+func (g Gate) Cap() int {
+	return cap(g)
+}
+
+// InstrumentedGate wraps a Gate with go-metrics counters for wait time and
+// saturation, so operators can tune the configured width.
+type InstrumentedGate struct {
+	Gate
+	waitNs     metrics.Counter
+	saturation metrics.Gauge
+}
+
+// NewInstrumentedGate builds a Gate of width n along with the metrics needed
+// to observe how busy it is.
+func NewInstrumentedGate(n int, waitNs metrics.Counter, saturation metrics.Gauge) InstrumentedGate {
+	return InstrumentedGate{NewGate(n), waitNs, saturation}
+}
+
+// Start acquires a slot like Gate.Start, recording how long the caller
+// waited and the gate's resulting saturation.
+func (g InstrumentedGate) Start() {
+	t0 := time.Now()
+	g.Gate.Start()
+	if g.waitNs != nil {
+		g.waitNs.Inc(int64(time.Since(t0)))
+	}
+	if g.saturation != nil {
+		g.saturation.Update(int64(g.Gate.Len()))
+	}
+}
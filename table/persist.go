@@ -0,0 +1,180 @@
+package table
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/graphite-ng/carbon-relay-ng/aggregator"
+	"github.com/graphite-ng/carbon-relay-ng/matcher"
+	"github.com/graphite-ng/carbon-relay-ng/rewriter"
+)
+
+// tableSnapshotVersion is bumped whenever the on-disk format of
+// TableSnapshot changes, so Restore can reject or migrate stale files.
+const tableSnapshotVersion = 1
+
+// persistDebounce is how long Table waits for mutations to settle before
+// writing a snapshot to disk, so a burst of imperatives commands results in
+// one write instead of one per command.
+const persistDebounce = 2 * time.Second
+
+type persistedSnapshot struct {
+	Version  int
+	Snapshot TableSnapshot
+}
+
+// MarshalBinary gob-encodes the snapshot together with a version tag, so a
+// future format change can be migrated by UnmarshalBinary.
+func (t TableSnapshot) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(persistedSnapshot{tableSnapshotVersion, t}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a snapshot written by MarshalBinary.
+func (t *TableSnapshot) UnmarshalBinary(data []byte) error {
+	var p persistedSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&p); err != nil {
+		return err
+	}
+	if p.Version != tableSnapshotVersion {
+		return fmt.Errorf("unsupported table snapshot version %d (want %d)", p.Version, tableSnapshotVersion)
+	}
+	*t = p.Snapshot
+	return nil
+}
+
+// Persist atomically writes the table's current snapshot to path, so that
+// topology configured at runtime via the imperatives API survives a
+// restart. Callers that want this to happen automatically should use
+// EnablePersistence instead of calling Persist directly.
+func (table *Table) Persist(path string) error {
+	data, err := table.Snapshot().MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Restore rebuilds rewriters, blacklist entries, aggregators and
+// subscriptions from a snapshot previously written by Persist. it's meant
+// to be called during New/InitFromConfig, before any config-driven Init*
+// calls, so runtime-configured topology isn't lost across a restart.
+//
+// Routes aren't reconnected from the snapshot: their destinations require
+// live connections, which config-driven InitRoutes is responsible for
+// (re)establishing. A restored route is logged so operators can tell it's
+// pending re-creation via config.
+func (table *Table) Restore(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var snap TableSnapshot
+	if err := snap.UnmarshalBinary(data); err != nil {
+		return err
+	}
+
+	for _, rw := range snap.Rewriters {
+		// rewriter.RW's compiled regex is unexported and doesn't survive gob,
+		// so rebuild it via New from the decoded pattern fields rather than
+		// reusing the decoded value, same as aggregators/subscriptions below.
+		rebuilt, err := rewriter.New(rw.Old, rw.New, rw.Max)
+		if err != nil {
+			log.Error("restore: could not rebuild rewriter '%s': %s", rw.Old, err.Error())
+			continue
+		}
+		table.AddRewriter(rebuilt)
+	}
+	for _, b := range snap.Blacklist {
+		// same story: Matcher's compiled prefix/sub/regex are unexported and
+		// gob only restores the pattern strings, so a decoded Matcher matches
+		// everything. Rebuild via New instead of reusing the decoded struct.
+		m, err := matcher.New(b.Prefix, b.Sub, b.Regex)
+		if err != nil {
+			log.Error("restore: could not rebuild blacklist matcher '%s': %s", b.Regex, err.Error())
+			continue
+		}
+		table.AddBlacklist(m)
+	}
+	for _, agg := range snap.Aggregators {
+		// gob only restores agg's exported config fields: its In channel is
+		// unexported and skipped, so the decoded value isn't a working
+		// aggregator. Feed the config into New to get one with a live input
+		// channel and running goroutine, same as InitAggregation does.
+		rebuilt, err := aggregator.New(agg.Fun, agg.Regex, agg.OutFmt, agg.Interval, agg.Wait, table.In)
+		if err != nil {
+			log.Error("restore: could not rebuild aggregator '%s': %s", agg.Regex, err.Error())
+			continue
+		}
+		table.AddAggregator(rebuilt)
+	}
+	for _, sub := range snap.Subscriptions {
+		// same story as aggregators: Subscriber.in/numSent/numDropped are
+		// unexported and don't survive gob, so rebuild live Subscribers (and
+		// recompile the Subscription's matcher) via their constructors
+		// instead of reusing the decoded structs.
+		m, err := matcher.New(sub.Matcher.Prefix, sub.Matcher.Sub, sub.Matcher.Regex)
+		if err != nil {
+			log.Error("restore: could not rebuild matcher for subscription '%s': %s", sub.Key, err.Error())
+			continue
+		}
+		subscribers := make([]*Subscriber, 0, len(sub.Subscribers))
+		for _, s := range sub.Subscribers {
+			subscribers = append(subscribers, NewSubscriber(sub.Key, s.Protocol, s.Addr))
+		}
+		table.AddSubscription(NewSubscription(sub.Key, m, sub.Mode, subscribers))
+	}
+	for _, r := range snap.Routes {
+		log.Notice("restore: route '%s' (type %s) found in persisted config; re-add it via config to reconnect its destinations", r.Key, r.Type)
+	}
+
+	return nil
+}
+
+// EnablePersistence turns on debounced background persistence of the
+// table's topology to path: every mutation (AddRoute, DelRoute,
+// AddAggregator, UpdateRoute, etc.) schedules a write, coalesced so a burst
+// of changes produces a single Persist call persistDebounce after the last
+// one.
+func (table *Table) EnablePersistence(path string) {
+	table.persistMu.Lock()
+	defer table.persistMu.Unlock()
+	table.persistPath = path
+}
+
+// schedulePersist debounces a background Persist call. it's a no-op until
+// EnablePersistence has been called.
+func (table *Table) schedulePersist() {
+	table.persistMu.Lock()
+	defer table.persistMu.Unlock()
+
+	if table.persistPath == "" {
+		return
+	}
+
+	if table.persistTimer != nil {
+		table.persistTimer.Stop()
+	}
+	path := table.persistPath
+	table.persistTimer = time.AfterFunc(persistDebounce, func() {
+		if err := table.Persist(path); err != nil {
+			log.Error("could not persist table config to %s: %s", path, err.Error())
+		}
+	})
+}
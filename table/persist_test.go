@@ -0,0 +1,51 @@
+package table
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/graphite-ng/carbon-relay-ng/matcher"
+)
+
+// TestPersistRestoreBlacklist catches the gob round-trip bug where a
+// restored blacklist matcher, built straight from the decoded struct,
+// matched everything instead of just its configured pattern.
+func TestPersistRestoreBlacklist(t *testing.T) {
+	f, err := ioutil.TempFile("", "carbon-relay-ng-persist-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	orig := New("")
+	m, err := matcher.New("blacklisted.", "", "")
+	if err != nil {
+		t.Fatalf("could not build matcher: %s", err.Error())
+	}
+	orig.AddBlacklist(m)
+
+	if err := orig.Persist(path); err != nil {
+		t.Fatalf("persist: %s", err.Error())
+	}
+
+	restored := New("")
+	if err := restored.Restore(path); err != nil {
+		t.Fatalf("restore: %s", err.Error())
+	}
+
+	snap := restored.Snapshot()
+	if len(snap.Blacklist) != 1 {
+		t.Fatalf("expected 1 restored blacklist entry, got %d", len(snap.Blacklist))
+	}
+
+	restoredMatcher := snap.Blacklist[0]
+	if !restoredMatcher.Match([]byte("blacklisted.foo")) {
+		t.Error("restored blacklist matcher should still match its configured prefix")
+	}
+	if restoredMatcher.Match([]byte("other.metric")) {
+		t.Error("restored blacklist matcher matches metrics outside its prefix; it wasn't rebuilt from the decoded fields")
+	}
+}
@@ -0,0 +1,137 @@
+// Package retention parses graphite storage-schemas.conf files and resolves
+// a metric to the schema (and therefore the retention tiers) that applies
+// to it, the same matching rules carbon-cache uses.
+package retention
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Retention is a single interval:period rollup, e.g. "10s:1d".
+type Retention struct {
+	Interval string
+	Period   string
+}
+
+func (r Retention) String() string {
+	return r.Interval + ":" + r.Period
+}
+
+// Schema is one [section] of a storage-schemas.conf file: a pattern and the
+// ordered list of rollups (finest to coarsest) that apply to metrics
+// matching it.
+type Schema struct {
+	Name       string
+	PatternRaw string
+	Retentions []Retention
+
+	pattern *regexp.Regexp
+}
+
+// Coarsest returns the schema's highest rollup tier, e.g. "1h:2y" out of
+// "10s:1d,1m:30d,1h:2y". storage-schemas.conf lists retentions from finest
+// to coarsest, same convention whisper/carbon use.
+func (s Schema) Coarsest() Retention {
+	return s.Retentions[len(s.Retentions)-1]
+}
+
+func (s Schema) match(metric string) bool {
+	return s.pattern.MatchString(metric)
+}
+
+// Policy is a set of schemas parsed from a storage-schemas.conf file,
+// matched in file order like carbon-cache does (first match wins).
+type Policy struct {
+	Schemas []Schema
+}
+
+// Match returns the first schema whose pattern matches metric.
+func (p *Policy) Match(metric string) (Schema, bool) {
+	for _, s := range p.Schemas {
+		if s.match(metric) {
+			return s, true
+		}
+	}
+	return Schema{}, false
+}
+
+// ParseFile parses a graphite storage-schemas.conf file into a Policy.
+func ParseFile(path string) (*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var schemas []Schema
+	var cur *Schema
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if cur != nil {
+				schemas = append(schemas, *cur)
+			}
+			cur = &Schema{Name: strings.TrimSuffix(strings.TrimPrefix(line, "["), "]")}
+			continue
+		}
+
+		if cur == nil {
+			return nil, fmt.Errorf("line %d: retention entry outside of a [section]", lineNum)
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("line %d: invalid line %q", lineNum, line)
+		}
+		key := strings.TrimSpace(kv[0])
+		val := strings.TrimSpace(kv[1])
+
+		switch key {
+		case "pattern":
+			re, err := regexp.Compile(val)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid pattern %q: %s", lineNum, val, err.Error())
+			}
+			cur.PatternRaw = val
+			cur.pattern = re
+		case "retentions":
+			cur.Retentions = nil
+			for _, r := range strings.Split(val, ",") {
+				parts := strings.SplitN(strings.TrimSpace(r), ":", 2)
+				if len(parts) != 2 {
+					return nil, fmt.Errorf("line %d: invalid retention %q", lineNum, r)
+				}
+				cur.Retentions = append(cur.Retentions, Retention{parts[0], parts[1]})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if cur != nil {
+		schemas = append(schemas, *cur)
+	}
+
+	for _, s := range schemas {
+		if s.pattern == nil {
+			return nil, fmt.Errorf("schema %q has no pattern", s.Name)
+		}
+		if len(s.Retentions) == 0 {
+			return nil, fmt.Errorf("schema %q has no retentions", s.Name)
+		}
+	}
+
+	return &Policy{schemas}, nil
+}
@@ -0,0 +1,163 @@
+package table
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/graphite-ng/carbon-relay-ng/matcher"
+	"github.com/graphite-ng/carbon-relay-ng/stats"
+)
+
+// SubscriptionMode controls when a Subscription considers a metric delivered.
+type SubscriptionMode int
+
+const (
+	// SubscriptionModeAll fans the metric out to every subscriber.
+	SubscriptionModeAll SubscriptionMode = iota
+	// SubscriptionModeAny delivers to the first subscriber that will take it.
+	SubscriptionModeAny
+)
+
+// subscriberBufSize bounds how many metric lines we'll queue for a subscriber
+// before we start dropping, so a slow or dead subscriber can never apply
+// backpressure to Dispatch.
+const subscriberBufSize = 10000
+
+// Subscriber is a single fan-out destination for a Subscription: a plain TCP
+// or UDP line-protocol listener, or an HTTP webhook.
+type Subscriber struct {
+	Addr     string
+	Protocol string // "tcp", "udp" or "http"
+
+	in         chan []byte
+	numSent    metrics.Counter
+	numDropped metrics.Counter
+}
+
+// NewSubscriber creates a Subscriber and starts its delivery loop.
+// key identifies the owning Subscription, for stats bucketing.
+func NewSubscriber(key, protocol, addr string) *Subscriber {
+	s := &Subscriber{
+		Addr:       addr,
+		Protocol:   protocol,
+		in:         make(chan []byte, subscriberBufSize),
+		numSent:    stats.Counter(fmt.Sprintf("unit=Metric.direction=sent.subscription=%s.target=%s", key, addr)),
+		numDropped: stats.Counter(fmt.Sprintf("unit=Metric.direction=dropped.subscription=%s.target=%s", key, addr)),
+	}
+	go s.run()
+	return s
+}
+
+// send enqueues buf for delivery without blocking the caller. it returns
+// false (and bumps numDropped) if the subscriber's buffer is full.
+func (s *Subscriber) send(buf []byte) bool {
+	cp := make([]byte, len(buf))
+	copy(cp, buf)
+	select {
+	case s.in <- cp:
+		return true
+	default:
+		s.numDropped.Inc(1)
+		return false
+	}
+}
+
+func (s *Subscriber) run() {
+	if s.Protocol == "http" {
+		s.runHTTP()
+		return
+	}
+	s.runConn()
+}
+
+// runConn delivers over tcp or udp on a single persistent connection,
+// redialing on demand whenever it's missing or a write fails; subscribers
+// are meant for shadowing traffic, not for guaranteed delivery, but dialing
+// fresh per line would exhaust ephemeral ports/sockets at any real rate.
+func (s *Subscriber) runConn() {
+	var conn net.Conn
+	for buf := range s.in {
+		if conn == nil {
+			c, err := net.DialTimeout(s.Protocol, s.Addr, time.Second)
+			if err != nil {
+				log.Warning("subscription: could not dial %s %s: %s", s.Protocol, s.Addr, err.Error())
+				continue
+			}
+			conn = c
+		}
+
+		_, err := conn.Write(buf)
+		if err == nil {
+			_, err = conn.Write([]byte("\n"))
+		}
+		if err != nil {
+			log.Warning("subscription: write to %s %s failed, will redial: %s", s.Protocol, s.Addr, err.Error())
+			conn.Close()
+			conn = nil
+			continue
+		}
+		s.numSent.Inc(1)
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func (s *Subscriber) runHTTP() {
+	client := &http.Client{Timeout: 5 * time.Second}
+	for buf := range s.in {
+		resp, err := client.Post(s.Addr, "application/octet-stream", bytes.NewReader(buf))
+		if err != nil {
+			log.Warning("subscription: webhook post to %s failed: %s", s.Addr, err.Error())
+			continue
+		}
+		resp.Body.Close()
+		s.numSent.Inc(1)
+	}
+}
+
+func (s *Subscriber) shutdown() {
+	close(s.in)
+}
+
+// Subscription mirrors matching traffic to a set of Subscribers, independently
+// of routing: it never affects `routed`/`numUnroutable` accounting and can be
+// added or removed at runtime without touching the routing table.
+type Subscription struct {
+	Key         string
+	Matcher     *matcher.Matcher
+	Mode        SubscriptionMode
+	Subscribers []*Subscriber
+}
+
+// NewSubscription creates a Subscription. The Subscribers are expected to be
+// running already, same convention as AddRoute.
+func NewSubscription(key string, matcher *matcher.Matcher, mode SubscriptionMode, subscribers []*Subscriber) *Subscription {
+	return &Subscription{key, matcher, mode, subscribers}
+}
+
+// dispatch sends final to the Subscription's subscribers if key matches its
+// matcher: to all of them in ALL mode, or only up to the first that accepts
+// it in ANY mode. it never blocks: each Subscriber has its own
+// bounded buffer and drops rather than stalling the caller.
+func (sub *Subscription) dispatch(key, final []byte) {
+	if !sub.Matcher.Match(key) {
+		return
+	}
+	for _, s := range sub.Subscribers {
+		delivered := s.send(final)
+		if sub.Mode == SubscriptionModeAny && delivered {
+			return
+		}
+	}
+}
+
+func (sub *Subscription) shutdown() {
+	for _, s := range sub.Subscribers {
+		s.shutdown()
+	}
+}
@@ -0,0 +1,90 @@
+package table
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/graphite-ng/carbon-relay-ng/matcher"
+)
+
+// ApplySubscriptionCmd parses and applies a single addSub/delSub command, the
+// same way imperatives.Apply handles route commands. Subscriptions get their
+// own tiny grammar here instead of one in the imperatives package, since that
+// package only knows about routes; this is what lets InitCmd create/remove
+// subscriptions at runtime instead of only from config.
+//
+//	addSub <key> <all|any> [prefix=<p>] [sub=<s>] [regex=<r>] <proto>:<addr> [<proto>:<addr> ...]
+//	delSub <key>
+func (table *Table) ApplySubscriptionCmd(cmd string) error {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return fmt.Errorf("empty subscription command")
+	}
+
+	switch fields[0] {
+	case "delSub":
+		if len(fields) != 2 {
+			return fmt.Errorf("delSub takes exactly 1 argument: <key>")
+		}
+		return table.DelSubscription(fields[1])
+	case "addSub":
+		return table.applyAddSub(fields[1:])
+	}
+	return fmt.Errorf("unknown subscription command '%s'", fields[0])
+}
+
+func (table *Table) applyAddSub(fields []string) error {
+	if len(fields) < 3 {
+		return fmt.Errorf("addSub requires at least <key> <all|any> and one <proto>:<addr> subscriber")
+	}
+	key := fields[0]
+
+	var mode SubscriptionMode
+	switch fields[1] {
+	case "all":
+		mode = SubscriptionModeAll
+	case "any":
+		mode = SubscriptionModeAny
+	default:
+		return fmt.Errorf("invalid subscription mode '%s', must be 'all' or 'any'", fields[1])
+	}
+
+	if table.GetSubscription(key) != nil {
+		return fmt.Errorf("a subscription with key '%s' already exists", key)
+	}
+
+	var prefix, sub, regex string
+	var subscriberSpecs []string
+	for _, f := range fields[2:] {
+		switch {
+		case strings.HasPrefix(f, "prefix="):
+			prefix = strings.TrimPrefix(f, "prefix=")
+		case strings.HasPrefix(f, "sub="):
+			sub = strings.TrimPrefix(f, "sub=")
+		case strings.HasPrefix(f, "regex="):
+			regex = strings.TrimPrefix(f, "regex=")
+		default:
+			subscriberSpecs = append(subscriberSpecs, f)
+		}
+	}
+	if len(subscriberSpecs) == 0 {
+		return fmt.Errorf("addSub '%s' needs at least one subscriber of the form <protocol>:<addr>", key)
+	}
+
+	m, err := matcher.New(prefix, sub, regex)
+	if err != nil {
+		return err
+	}
+
+	subscribers := make([]*Subscriber, 0, len(subscriberSpecs))
+	for _, spec := range subscriberSpecs {
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid subscriber '%s', want <protocol>:<addr>", spec)
+		}
+		subscribers = append(subscribers, NewSubscriber(key, parts[0], parts[1]))
+	}
+
+	table.AddSubscription(NewSubscription(key, m, mode, subscribers))
+	return nil
+}
@@ -3,9 +3,11 @@ package table
 import (
 	"bytes"
 	"fmt"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/Dieterbe/go-metrics"
 	"github.com/graphite-ng/carbon-relay-ng/aggregator"
@@ -15,13 +17,26 @@ import (
 	"github.com/graphite-ng/carbon-relay-ng/rewriter"
 	"github.com/graphite-ng/carbon-relay-ng/route"
 	"github.com/graphite-ng/carbon-relay-ng/stats"
+	"github.com/graphite-ng/carbon-relay-ng/syncutil"
 )
 
+// defaultDispatchConcurrency is the dispatch gate width used when cfg.Config
+// doesn't set dispatch_concurrency. It only comes into play when more than
+// dispatchParallelThreshold routes match a metric.
+const defaultDispatchConcurrency = 20
+
+// dispatchParallelThreshold is the number of matching routes above which
+// it's worth paying for a goroutine + gate per route; below it, the cost of
+// the channel op and metric update exceeds whatever parallelism buys us, so
+// we just dispatch serially on the caller's goroutine.
+const dispatchParallelThreshold = 4
+
 type TableConfig struct {
-	rewriters   []rewriter.RW
-	aggregators []*aggregator.Aggregator
-	blacklist   []*matcher.Matcher
-	routes      []route.Route
+	rewriters     []rewriter.RW
+	aggregators   []*aggregator.Aggregator
+	blacklist     []*matcher.Matcher
+	routes        []route.Route
+	subscriptions []*Subscription
 }
 
 type Table struct {
@@ -31,14 +46,19 @@ type Table struct {
 	numBlacklist  metrics.Counter
 	numUnroutable metrics.Counter
 	In            chan []byte `json:"-"` // channel api to trade in some performance for encapsulation, for aggregators
+	dispatchGate  syncutil.InstrumentedGate
+	persistMu     sync.Mutex
+	persistPath   string
+	persistTimer  *time.Timer
 }
 
 type TableSnapshot struct {
-	Rewriters   []rewriter.RW            `json:"rewriters"`
-	Aggregators []*aggregator.Aggregator `json:"aggregators"`
-	Blacklist   []*matcher.Matcher       `json:"blacklist"`
-	Routes      []route.Snapshot         `json:"routes"`
-	SpoolDir    string
+	Rewriters     []rewriter.RW            `json:"rewriters"`
+	Aggregators   []*aggregator.Aggregator `json:"aggregators"`
+	Blacklist     []*matcher.Matcher       `json:"blacklist"`
+	Routes        []route.Snapshot         `json:"routes"`
+	Subscriptions []*Subscription          `json:"subscriptions"`
+	SpoolDir      string
 }
 
 func New(spoolDir string) *Table {
@@ -49,6 +69,14 @@ func New(spoolDir string) *Table {
 		stats.Counter("unit=Metric.direction=blacklist"),
 		stats.Counter("unit=Metric.direction=unroutable"),
 		make(chan []byte),
+		syncutil.NewInstrumentedGate(
+			defaultDispatchConcurrency,
+			stats.Counter("unit=ns.target_type=gauge.what=dispatch_gate_wait"),
+			stats.Gauge("unit=Count.target_type=gauge.what=dispatch_gate_saturation"),
+		),
+		sync.Mutex{},
+		"",
+		nil,
 	}
 
 	t.config.Store(TableConfig{
@@ -56,6 +84,7 @@ func New(spoolDir string) *Table {
 		make([]*aggregator.Aggregator, 0),
 		make([]*matcher.Matcher, 0),
 		make([]route.Route, 0),
+		make([]*Subscription, 0),
 	})
 
 	go func() {
@@ -74,6 +103,49 @@ func (table *Table) GetSpoolDir() string {
 	return table.SpoolDir
 }
 
+// SetDispatchConcurrency resizes the gate used to parallelize per-route
+// dispatch and aggregator PreMatch fan-out. n <= 0 means unbounded.
+func (table *Table) SetDispatchConcurrency(n int) {
+	table.Lock()
+	defer table.Unlock()
+	table.dispatchGate = syncutil.NewInstrumentedGate(
+		n,
+		stats.Counter("unit=ns.target_type=gauge.what=dispatch_gate_wait"),
+		stats.Gauge("unit=Count.target_type=gauge.what=dispatch_gate_saturation"),
+	)
+}
+
+// schemaReloader is implemented by routes (currently only RetentionRoute)
+// that hold their own retention policy parsed from a storage-schemas.conf
+// file and can hot-reload it.
+type schemaReloader interface {
+	ReloadSchemas(path string) error
+}
+
+// ReloadSchemas re-parses the graphite storage-schemas.conf file at path
+// into every retentionRoute's policy, one route at a time, so the imperatives
+// interface can hot-reload retention tiers without a restart. It stops at the
+// first route that fails to reload; routes before it keep the new policy.
+func (table *Table) ReloadSchemas(path string) error {
+	conf := table.config.Load().(TableConfig)
+
+	var reloaded int
+	for _, r := range conf.routes {
+		rr, ok := r.(schemaReloader)
+		if !ok {
+			continue
+		}
+		if err := rr.ReloadSchemas(path); err != nil {
+			return fmt.Errorf("could not reload schemas for route '%s': %s", r.Key(), err.Error())
+		}
+		reloaded++
+	}
+	if reloaded == 0 {
+		return fmt.Errorf("no retentionRoute found to reload schemas for")
+	}
+	return nil
+}
+
 // Dispatch dispatches incoming metrics into matching aggregators and routes,
 // after checking against the blacklist
 // buf is assumed to have no whitespace at the end
@@ -93,12 +165,27 @@ func (table *Table) Dispatch(buf []byte) {
 		}
 	}
 
+	// aggregator.In sends are deliberately not gated: they can block for as
+	// long as a flush into table.In takes, and table.In's only reader is the
+	// goroutine running DispatchAggregate, which itself acquires
+	// dispatchGate slots for route fan-out. Gating both on the same slots
+	// lets all slots fill with blocked aggregator sends while
+	// DispatchAggregate waits for a slot to drain table.In - a circular
+	// wait. Each matching aggregator still gets its own goroutine so one
+	// slow aggregator can't hold up another.
+	var aggWg sync.WaitGroup
 	for _, aggregator := range conf.aggregators {
+		aggregator := aggregator
 		// we rely on incoming metrics already having been validated
 		if aggregator.PreMatch(fields[0]) {
-			aggregator.In <- fields
+			aggWg.Add(1)
+			go func() {
+				defer aggWg.Done()
+				aggregator.In <- fields
+			}()
 		}
 	}
+	aggWg.Wait()
 
 	for _, rw := range conf.rewriters {
 		fields[0] = rw.Do(fields[0])
@@ -106,41 +193,73 @@ func (table *Table) Dispatch(buf []byte) {
 
 	final := bytes.Join(fields, []byte(" "))
 
-	routed := false
-
+	var matched []route.Route
 	for _, route := range conf.routes {
 		if route.Match(fields[0]) {
-			routed = true
-			log.Info("table sending to route: %s", final)
-			route.Dispatch(final)
+			matched = append(matched, route)
 		}
 	}
+	table.dispatchToRoutes(matched, final)
 
-	if !routed {
+	if len(matched) == 0 {
 		table.numUnroutable.Inc(1)
 		log.Notice("unrouteable: %s\n", final)
 	}
+
+	for _, sub := range conf.subscriptions {
+		sub.dispatch(fields[0], final)
+	}
+}
+
+// dispatchToRoutes sends buf to every route in matched. Above
+// dispatchParallelThreshold matches it gates/parallelizes the sends, same as
+// before; below it, the goroutine and gate overhead costs more than it could
+// possibly save, so it just dispatches serially on the caller's goroutine.
+func (table *Table) dispatchToRoutes(matched []route.Route, buf []byte) {
+	if len(matched) <= dispatchParallelThreshold {
+		for _, r := range matched {
+			log.Info("table sending to route: %s", buf)
+			r.Dispatch(buf)
+		}
+		return
+	}
+
+	var routeWg sync.WaitGroup
+	for _, r := range matched {
+		r := r
+		routeWg.Add(1)
+		table.dispatchGate.Start()
+		go func() {
+			defer routeWg.Done()
+			defer table.dispatchGate.Done()
+			log.Info("table sending to route: %s", buf)
+			r.Dispatch(buf)
+		}()
+	}
+	routeWg.Wait()
 }
 
 // DispatchAggregate dispatches aggregation output by routing metrics into the matching routes.
 // buf is assumed to have no whitespace at the end
 func (table *Table) DispatchAggregate(buf []byte) {
 	conf := table.config.Load().(TableConfig)
-	routed := false
 
+	var matched []route.Route
 	for _, route := range conf.routes {
 		if route.Match(buf) {
-			routed = true
-			log.Info("table sending to route: %s", buf)
-			route.Dispatch(buf)
+			matched = append(matched, route)
 		}
 	}
+	table.dispatchToRoutes(matched, buf)
 
-	if !routed {
+	if len(matched) == 0 {
 		table.numUnroutable.Inc(1)
 		log.Notice("unrouteable: %s\n", buf)
 	}
 
+	for _, sub := range conf.subscriptions {
+		sub.dispatch(buf, buf)
+	}
 }
 
 // to view the state of the table/route at any point in time
@@ -167,7 +286,13 @@ func (table *Table) Snapshot() TableSnapshot {
 	for i, a := range conf.aggregators {
 		aggs[i] = a.Snapshot()
 	}
-	return TableSnapshot{rewriters, aggs, blacklist, routes, table.SpoolDir}
+
+	subs := make([]*Subscription, len(conf.subscriptions))
+	for i, s := range conf.subscriptions {
+		subs[i] = s
+	}
+
+	return TableSnapshot{rewriters, aggs, blacklist, routes, subs, table.SpoolDir}
 }
 
 func (table *Table) GetRoute(key string) route.Route {
@@ -188,6 +313,30 @@ func (table *Table) AddRoute(route route.Route) {
 	conf := table.config.Load().(TableConfig)
 	conf.routes = append(conf.routes, route)
 	table.config.Store(conf)
+	table.schedulePersist()
+}
+
+// GetSubscription returns the subscription with the given key, or nil if
+// there isn't one.
+func (table *Table) GetSubscription(key string) *Subscription {
+	conf := table.config.Load().(TableConfig)
+	for _, sub := range conf.subscriptions {
+		if sub.Key == key {
+			return sub
+		}
+	}
+	return nil
+}
+
+// AddSubscription adds a subscription to the table.
+// Its Subscribers must be running already.
+func (table *Table) AddSubscription(sub *Subscription) {
+	table.Lock()
+	defer table.Unlock()
+	conf := table.config.Load().(TableConfig)
+	conf.subscriptions = append(conf.subscriptions, sub)
+	table.config.Store(conf)
+	table.schedulePersist()
 }
 
 func (table *Table) AddBlacklist(matcher *matcher.Matcher) {
@@ -196,6 +345,7 @@ func (table *Table) AddBlacklist(matcher *matcher.Matcher) {
 	conf := table.config.Load().(TableConfig)
 	conf.blacklist = append(conf.blacklist, matcher)
 	table.config.Store(conf)
+	table.schedulePersist()
 }
 
 func (table *Table) AddAggregator(agg *aggregator.Aggregator) {
@@ -204,6 +354,7 @@ func (table *Table) AddAggregator(agg *aggregator.Aggregator) {
 	conf := table.config.Load().(TableConfig)
 	conf.aggregators = append(conf.aggregators, agg)
 	table.config.Store(conf)
+	table.schedulePersist()
 }
 
 func (table *Table) AddRewriter(rw rewriter.RW) {
@@ -212,6 +363,7 @@ func (table *Table) AddRewriter(rw rewriter.RW) {
 	conf := table.config.Load().(TableConfig)
 	conf.rewriters = append(conf.rewriters, rw)
 	table.config.Store(conf)
+	table.schedulePersist()
 }
 
 func (table *Table) Flush() error {
@@ -236,6 +388,10 @@ func (table *Table) Shutdown() error {
 		}
 	}
 	conf.routes = make([]route.Route, 0)
+	for _, sub := range conf.subscriptions {
+		sub.shutdown()
+	}
+	conf.subscriptions = make([]*Subscription, 0)
 	table.config.Store(conf)
 	return nil
 }
@@ -256,6 +412,7 @@ func (table *Table) DelAggregator(id int) error {
 	fmt.Println("len", len(conf.aggregators))
 	agg.Shutdown()
 	table.config.Store(conf)
+	table.schedulePersist()
 	return nil
 }
 
@@ -268,6 +425,7 @@ func (table *Table) DelBlacklist(index int) error {
 	}
 	conf.blacklist = append(conf.blacklist[:index], conf.blacklist[index+1:]...)
 	table.config.Store(conf)
+	table.schedulePersist()
 	return nil
 }
 
@@ -291,6 +449,33 @@ func (table *Table) DelRewriter(id int) error {
 
 	conf.rewriters = append(conf.rewriters[:id], conf.rewriters[id+1:]...)
 	table.config.Store(conf)
+	table.schedulePersist()
+	return nil
+}
+
+// idempotent semantics, not existing is fine
+func (table *Table) DelSubscription(key string) error {
+	table.Lock()
+	defer table.Unlock()
+	conf := table.config.Load().(TableConfig)
+	toDelete := -1
+	var i int
+	var sub *Subscription
+	for i, sub = range conf.subscriptions {
+		if sub.Key == key {
+			toDelete = i
+			break
+		}
+	}
+	if toDelete == -1 {
+		return nil
+	}
+
+	conf.subscriptions = append(conf.subscriptions[:toDelete], conf.subscriptions[toDelete+1:]...)
+	table.config.Store(conf)
+	table.schedulePersist()
+
+	sub.shutdown()
 	return nil
 }
 
@@ -314,6 +499,7 @@ func (table *Table) DelRoute(key string) error {
 
 	conf.routes = append(conf.routes[:toDelete], conf.routes[toDelete+1:]...)
 	table.config.Store(conf)
+	table.schedulePersist()
 
 	err := route.Shutdown()
 	if err != nil {
@@ -329,7 +515,11 @@ func (table *Table) UpdateDestination(key string, index int, opts map[string]str
 	if route == nil {
 		return fmt.Errorf("Invalid route for %v", key)
 	}
-	return route.UpdateDestination(index, opts)
+	err := route.UpdateDestination(index, opts)
+	if err == nil {
+		table.schedulePersist()
+	}
+	return err
 }
 
 func (table *Table) UpdateRoute(key string, opts map[string]string) error {
@@ -337,7 +527,11 @@ func (table *Table) UpdateRoute(key string, opts map[string]string) error {
 	if route == nil {
 		return fmt.Errorf("Invalid route for %v", key)
 	}
-	return route.Update(opts)
+	err := route.Update(opts)
+	if err == nil {
+		table.schedulePersist()
+	}
+	return err
 }
 
 func (table *Table) Print() (str string) {
@@ -468,6 +662,18 @@ func (table *Table) Print() (str string) {
 func InitFromConfig(config cfg.Config) (*Table, error) {
 	table := New(config.Spool_dir)
 
+	if config.Dispatch_concurrency != 0 {
+		table.SetDispatchConcurrency(config.Dispatch_concurrency)
+	}
+
+	if config.Persist_config {
+		persistPath := filepath.Join(config.Spool_dir, "table.snapshot")
+		if err := table.Restore(persistPath); err != nil {
+			log.Error("could not restore persisted table config from %s: %s", persistPath, err.Error())
+		}
+		table.EnablePersistence(persistPath)
+	}
+
 	err := table.InitCmd(config)
 	if err != nil {
 		return table, err
@@ -493,13 +699,24 @@ func InitFromConfig(config cfg.Config) (*Table, error) {
 		return table, err
 	}
 
+	err = table.InitSubscription(config)
+	if err != nil {
+		return table, err
+	}
+
 	return table, nil
 }
 
 func (table *Table) InitCmd(config cfg.Config) error {
 	for i, cmd := range config.Init {
 		log.Notice("applying: %s", cmd)
-		err := imperatives.Apply(table, cmd)
+
+		var err error
+		if strings.HasPrefix(cmd, "addSub ") || strings.HasPrefix(cmd, "delSub ") {
+			err = table.ApplySubscriptionCmd(cmd)
+		} else {
+			err = imperatives.Apply(table, cmd)
+		}
 		if err != nil {
 			log.Error(err.Error())
 			return fmt.Errorf("could not apply init cmd #%d", i+1)
@@ -557,6 +774,41 @@ func (table *Table) InitAggregation(config cfg.Config) error {
 	return nil
 }
 
+// InitSubscription sets up config-driven subscriptions/taps. Subscriptions
+// can also be created/removed at runtime via the addSub/delSub commands
+// handled by ApplySubscriptionCmd.
+func (table *Table) InitSubscription(config cfg.Config) error {
+	for i, subConfig := range config.Subscription {
+		// a subscription created at runtime (via AddSubscription) and then
+		// persisted is restored before InitSubscription runs; skip it here
+		// rather than starting a second, duplicate set of subscribers for
+		// the same key.
+		if table.GetSubscription(subConfig.Key) != nil {
+			continue
+		}
+
+		m, err := matcher.New(subConfig.Prefix, subConfig.Substr, subConfig.Regex)
+		if err != nil {
+			log.Error(err.Error())
+			return fmt.Errorf("could not add subscription #%d", i+1)
+		}
+
+		mode := SubscriptionModeAll
+		if subConfig.Mode == "any" {
+			mode = SubscriptionModeAny
+		}
+
+		subscribers := make([]*Subscriber, 0, len(subConfig.Subscribers))
+		for _, subscriberConfig := range subConfig.Subscribers {
+			subscribers = append(subscribers, NewSubscriber(subConfig.Key, subscriberConfig.Protocol, subscriberConfig.Addr))
+		}
+
+		table.AddSubscription(NewSubscription(subConfig.Key, m, mode, subscribers))
+	}
+
+	return nil
+}
+
 func (table *Table) InitRewrite(config cfg.Config) error {
 	for i, rewriterConfig := range config.Rewriter {
 		rw, err := rewriter.New(rewriterConfig.Old, rewriterConfig.New, rewriterConfig.Max)
@@ -625,7 +877,7 @@ func (table *Table) InitRoutes(config cfg.Config) error {
 		case "grafanaNet":
 			var spool bool
 			sslVerify := true
-			var bufSize = int(1e7)  // since a message is typically around 100B this is 1GB
+			var bufSize = int(1e7)  // since a message is typically around 100B this is ~10MB
 			var flushMaxNum = 10000 // number of metrics
 			var flushMaxWait = 500  // in ms
 			var timeout = 5000      // in ms
@@ -664,7 +916,7 @@ func (table *Table) InitRoutes(config cfg.Config) error {
 			}
 			table.AddRoute(route)
 		case "kafkaMdm":
-			var bufSize = int(1e7)  // since a message is typically around 100B this is 1GB
+			var bufSize = int(1e7)  // since a message is typically around 100B this is ~10MB
 			var flushMaxNum = 10000 // number of metrics
 			var flushMaxWait = 500  // in ms
 			var timeout = 2000      // in ms
@@ -692,6 +944,112 @@ func (table *Table) InitRoutes(config cfg.Config) error {
 				return fmt.Errorf("error adding route '%s'", routeConfig.Key)
 			}
 			table.AddRoute(route)
+		case "nats":
+			var bufSize = int(1e7)  // since a message is typically around 100B this is ~10MB
+			var flushMaxNum = 10000 // number of metrics
+			var flushMaxWait = 500  // in ms
+			var timeout = 2000      // in ms
+
+			if routeConfig.BufSize != 0 {
+				bufSize = routeConfig.BufSize
+			}
+			if routeConfig.FlushMaxNum != 0 {
+				flushMaxNum = routeConfig.FlushMaxNum
+			}
+			if routeConfig.FlushMaxWait != 0 {
+				flushMaxWait = routeConfig.FlushMaxWait
+			}
+			if routeConfig.Timeout != 0 {
+				timeout = routeConfig.Timeout
+			}
+
+			route, err := route.NewNats(routeConfig.Key, routeConfig.Prefix, routeConfig.Substr, routeConfig.Regex, routeConfig.NatsURL, routeConfig.NatsSubject, routeConfig.NatsCredsFile, routeConfig.NatsStream, routeConfig.SubjectTemplate, bufSize, flushMaxNum, flushMaxWait, timeout)
+			if err != nil {
+				log.Error(err.Error())
+				return fmt.Errorf("error adding route '%s'", routeConfig.Key)
+			}
+			table.AddRoute(route)
+		case "retentionRoute":
+			// a destination tagged "tier@destSpec" (e.g. "1h:2y@addr=...")
+			// backs that retention tier specifically; untagged destinations
+			// back the fallback bucket used for anything that doesn't match
+			// a tier with its own destinations. same "tier@addr" convention
+			// RetentionRoute.Snapshot already reports tiers with.
+			tierDestSpecs := make(map[string][]string)
+			var fallbackDestSpecs []string
+			for _, d := range routeConfig.Destinations {
+				idx := strings.Index(d, "@")
+				switch {
+				case idx > 0:
+					tierDestSpecs[d[:idx]] = append(tierDestSpecs[d[:idx]], d[idx+1:])
+				case idx == 0:
+					return fmt.Errorf("empty retention tier tag in destination '%s' for route '%s'", d, routeConfig.Key)
+				default:
+					fallbackDestSpecs = append(fallbackDestSpecs, d)
+				}
+			}
+			if len(tierDestSpecs) == 0 && len(fallbackDestSpecs) == 0 {
+				return fmt.Errorf("must get at least 1 destination for route '%s'", routeConfig.Key)
+			}
+
+			// started tracks the tier/fallback routes already brought up, so
+			// a later failure can tear them back down instead of leaking
+			// their live connections.
+			var started []route.Route
+			shutdownStarted := func() {
+				for _, r := range started {
+					if err := r.Shutdown(); err != nil {
+						log.Error("could not shut down partially configured route '%s': %s", routeConfig.Key, err.Error())
+					}
+				}
+			}
+
+			destinations := map[string]route.Route{}
+			for tier, specs := range tierDestSpecs {
+				dests, err := imperatives.ParseDestinations(specs, table, true)
+				if err != nil {
+					log.Error(err.Error())
+					shutdownStarted()
+					return fmt.Errorf("could not parse destinations for route '%s' tier '%s'", routeConfig.Key, tier)
+				}
+				if len(dests) == 0 {
+					shutdownStarted()
+					return fmt.Errorf("must get at least 1 destination for route '%s' tier '%s'", routeConfig.Key, tier)
+				}
+				tierRoute, err := route.NewSendAllMatch(routeConfig.Key+"_"+tier, "", "", "", dests)
+				if err != nil {
+					log.Error(err.Error())
+					shutdownStarted()
+					return fmt.Errorf("error adding route '%s' tier '%s'", routeConfig.Key, tier)
+				}
+				destinations[tier] = tierRoute
+				started = append(started, tierRoute)
+			}
+
+			var fallback route.Route
+			if len(fallbackDestSpecs) > 0 {
+				dests, err := imperatives.ParseDestinations(fallbackDestSpecs, table, true)
+				if err != nil {
+					log.Error(err.Error())
+					shutdownStarted()
+					return fmt.Errorf("could not parse destinations for route '%s'", routeConfig.Key)
+				}
+				fallback, err = route.NewSendAllMatch(routeConfig.Key+"_fallback", "", "", "", dests)
+				if err != nil {
+					log.Error(err.Error())
+					shutdownStarted()
+					return fmt.Errorf("error adding route '%s'", routeConfig.Key)
+				}
+				started = append(started, fallback)
+			}
+
+			route, err := route.NewRetentionRoute(routeConfig.Key, routeConfig.Prefix, routeConfig.Substr, routeConfig.Regex, routeConfig.SchemasFile, destinations, fallback)
+			if err != nil {
+				log.Error(err.Error())
+				shutdownStarted()
+				return fmt.Errorf("error adding route '%s'", routeConfig.Key)
+			}
+			table.AddRoute(route)
 		default:
 			return fmt.Errorf("unrecognized route type '%s'", routeConfig.Type)
 		}